@@ -1,11 +1,12 @@
 package pcx
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"image"
 	"image/color"
-	"fmt"
 	"io"
 	"io/ioutil"
 )
@@ -41,60 +42,43 @@ type Container struct {
 
 // Decode8Bit256Color decodes 8-bit 256 color pcx data into an image.
 func Decode8Bit256Color(r io.Reader) (img image.Image, err error) {
-	var (
-		raw      Container
-		paletted *image.Paletted
-		buf      []byte
-	)
-	buf, err = ioutil.ReadAll(r)
-	if err != nil {
-		return
-	}
-	pcxBytes := bytes.NewReader(buf)
-	raw, err = loadImage(pcxBytes)
+	raw, err := loadImage(r)
 	if err != nil {
-		return
+		return nil, err
 	}
 	if raw.Header.BitsPerPixelPerPlane != 8 {
-		err = fmt.Errorf("pcx: header says %d bits per pixel, expecting 8", raw.Header.BitsPerPixelPerPlane)
-		return
+		return nil, fmt.Errorf("pcx: header says %d bits per pixel, expecting 8", raw.Header.BitsPerPixelPerPlane)
 	}
 	if raw.Header.NumPlanes != 1 {
-		err = fmt.Errorf("pcx: header says %d planes, expecting 1", raw.Header.NumPlanes)
-		return
+		return nil, fmt.Errorf("pcx: header says %d planes, expecting 1", raw.Header.NumPlanes)
 	}
-	paletted, err = raw.palettedFromContainer()
+	paletted, err := raw.palettedFromContainer()
 	if err != nil {
-		return
+		return nil, err
 	}
-	img = paletted.SubImage(paletted.Rect)
-	return
+	return paletted.SubImage(paletted.Rect), nil
 }
 
 func (c *Container) palettedFromContainer() (*image.Paletted, error) {
-	result := &image.Paletted{}
-	newRect := image.Rectangle{
-		Min: image.Point{int(c.Header.WindowXMin), int(c.Header.WindowYMin)},
-		Max: image.Point{int(c.Header.WindowYMax) + 1, int(c.Header.WindowYMax) + 1},
-	}
-	decompressed, err := decompressWithRLE(c.Data)
-	if err != nil {
-		return nil, err
+	width := int(c.Header.WindowXMax) - int(c.Header.WindowXMin) + 1
+	height := int(c.Header.WindowYMax) - int(c.Header.WindowYMin) + 1
+	stride := int(c.Header.BytesPerPlaneLine) * int(c.Header.NumPlanes)
+
+	result := &image.Paletted{
+		Rect: image.Rectangle{
+			Min: image.Point{int(c.Header.WindowXMin), int(c.Header.WindowYMin)},
+			Max: image.Point{int(c.Header.WindowXMin) + width, int(c.Header.WindowYMin) + height},
+		},
+		Stride:  stride,
+		Pix:     make([]uint8, stride*height),
+		Palette: c.Palette,
 	}
-	dataReader := bytes.NewReader(decompressed)
-	result.Rect = newRect
-	result.Stride = int(c.Header.BytesPerPlaneLine)
-	result.Pix = make([]uint8, (result.Rect.Max.Y+1)*(result.Rect.Max.X+1))
-	result.Palette = c.Palette
-	for y := 0; y <= int(c.Header.WindowYMax); y++ {
-		for x := 0; x <= int(c.Header.WindowXMax); x++ {
-			index, err := dataReader.ReadByte()
-			if err != nil {
-				if err != io.EOF {
-					return nil, err
-				}
-			}
-			result.Set(x, y, c.Palette[int(index)])
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// c.Data rows are BytesPerPlaneLine*NumPlanes wide, which can
+			// be larger than width due to even-byte padding; only the
+			// first width bytes of each row are real pixels.
+			result.SetColorIndex(result.Rect.Min.X+x, result.Rect.Min.Y+y, c.Data[y*stride+x])
 		}
 	}
 	return result, nil
@@ -137,42 +121,471 @@ func decompressWithRLE(compressed []byte) ([]byte, error) {
 	}
 	return out.Bytes(), nil
 }
-func loadImage(r io.ReadSeeker) (Container, error) {
-	result := Container{}
+
+func init() {
+	image.RegisterFormat("pcx", "\x0a", Decode, DecodeConfig)
+}
+
+// DecodeConfig returns the dimensions and color model of a PCX image
+// without decoding pixel data. It reads the 128-byte header and, for 8bpp
+// x 1-plane images, streams to EOF to pick up the trailing 256-color
+// palette; other variants use the 16-color palette already in the header.
+func DecodeConfig(r io.Reader) (image.Config, error) {
 	headerRaw := make([]byte, 128)
-	_, err := r.Read(headerRaw)
+	if _, err := io.ReadFull(r, headerRaw); err != nil {
+		return image.Config{}, err
+	}
+	var h Header
+	if err := binary.Read(bytes.NewReader(headerRaw), binary.LittleEndian, &h); err != nil {
+		return image.Config{}, err
+	}
+	width := int(h.WindowXMax) - int(h.WindowXMin) + 1
+	height := int(h.WindowYMax) - int(h.WindowYMin) + 1
+
+	var model color.Model
+	switch {
+	case h.BitsPerPixelPerPlane == 8 && h.NumPlanes == 3:
+		model = color.RGBAModel
+	case h.BitsPerPixelPerPlane == 8 && h.NumPlanes == 1:
+		pal, err := readTrailingPalette(r)
+		if err != nil {
+			return image.Config{}, err
+		}
+		model = pal
+	default:
+		model = palette16FromHeader(h)
+	}
+	return image.Config{ColorModel: model, Width: width, Height: height}, nil
+}
+
+// readTrailingPalette streams r to EOF, keeping only the final 769 bytes,
+// to read the 0x0c marker and 256-color VGA palette without buffering the
+// pixel data in between.
+func readTrailingPalette(r io.Reader) (color.Palette, error) {
+	const tailLen = 769
+	tail := make([]byte, 0, tailLen)
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			tail = append(tail, buf[:n]...)
+			if len(tail) > tailLen {
+				tail = tail[len(tail)-tailLen:]
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(tail) < tailLen || tail[0] != 0x0c {
+		return nil, fmt.Errorf("pcx: missing 256-color palette marker")
+	}
+	pal := make(color.Palette, 256)
+	for i := 0; i < 256; i++ {
+		pal[i] = color.RGBA{tail[1+i*3], tail[1+i*3+1], tail[1+i*3+2], 0xff}
+	}
+	return pal, nil
+}
+
+// Decode decodes a PCX image, dispatching on the header's bits-per-pixel
+// and plane count to support monochrome (1bpp x 1 plane), EGA (1bpp x 4
+// planes), CGA/EGA packed-pixel (2bpp or 4bpp x 1 plane), 8-bit paletted
+// (8bpp x 1 plane) and 24-bit truecolor (8bpp x 3 planes) variants.
+func Decode(r io.Reader) (image.Image, error) {
+	buf, err := ioutil.ReadAll(r)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
-	err = binary.Read(bytes.NewReader(headerRaw), binary.LittleEndian, &result.Header)
+	if len(buf) < 128 {
+		return nil, fmt.Errorf("pcx: file too short for a header")
+	}
+	var h Header
+	if err := binary.Read(bytes.NewReader(buf[:128]), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	data := buf[128:]
+	switch {
+	case h.BitsPerPixelPerPlane == 8 && h.NumPlanes == 1:
+		return Decode8Bit256Color(bytes.NewReader(buf))
+	case h.BitsPerPixelPerPlane == 8 && h.NumPlanes == 3:
+		return decode24BitPlanes(h, data)
+	case h.BitsPerPixelPerPlane == 1 && h.NumPlanes == 4:
+		return decodeInterleavedPlanes(h, data)
+	case h.BitsPerPixelPerPlane == 1 && h.NumPlanes == 1:
+		return decodePackedPixels(h, data, 1)
+	case (h.BitsPerPixelPerPlane == 2 || h.BitsPerPixelPerPlane == 4) && h.NumPlanes == 1:
+		return decodePackedPixels(h, data, int(h.BitsPerPixelPerPlane))
+	default:
+		return nil, fmt.Errorf("pcx: unsupported combination of %d bits per pixel and %d planes", h.BitsPerPixelPerPlane, h.NumPlanes)
+	}
+}
+
+// palette16FromHeader converts the header's 16-color EGA/CGA palette into a
+// color.Palette for use by the low-bpp decoders.
+func palette16FromHeader(h Header) color.Palette {
+	pal := make(color.Palette, 16)
+	for i := 0; i < 16; i++ {
+		pal[i] = color.RGBA{h.Palette16[i*3], h.Palette16[i*3+1], h.Palette16[i*3+2], 0xff}
+	}
+	return pal
+}
+
+// decodePackedPixels decodes single-plane CGA/EGA/monochrome images where
+// 8/bpp pixels of bpp bits each are packed MSB-first into each byte of a
+// scanline.
+func decodePackedPixels(h Header, data []byte, bpp int) (image.Image, error) {
+	width := int(h.WindowXMax) - int(h.WindowXMin) + 1
+	height := int(h.WindowYMax) - int(h.WindowYMin) + 1
+	decompressed, err := decompressWithRLE(data)
 	if err != nil {
-		return result, err
+		return nil, err
+	}
+	stride := int(h.BytesPerPlaneLine)
+	if len(decompressed) < height*stride {
+		return nil, fmt.Errorf("pcx: decompressed data too short for %d scanlines of %d bytes", height, stride)
 	}
-	n, err := r.Seek(-0x300, io.SeekEnd)
+	pixelsPerByte := 8 / bpp
+	mask := byte(1<<uint(bpp)) - 1
+	img := image.NewPaletted(image.Rect(0, 0, width, height), palette16FromHeader(h))
+	for y := 0; y < height; y++ {
+		row := decompressed[y*stride : (y+1)*stride]
+		for x := 0; x < width; x++ {
+			byteIdx := x / pixelsPerByte
+			shift := uint(bpp) * uint(pixelsPerByte-1-x%pixelsPerByte)
+			img.SetColorIndex(x, y, (row[byteIdx]>>shift)&mask)
+		}
+	}
+	return img, nil
+}
+
+// decodeInterleavedPlanes decodes 1bpp x 4-plane EGA images, where each
+// scanline stores BytesPerPlaneLine bytes per plane back to back and bit i
+// of plane p contributes bit p of the resulting 4-bit palette index.
+func decodeInterleavedPlanes(h Header, data []byte) (image.Image, error) {
+	width := int(h.WindowXMax) - int(h.WindowXMin) + 1
+	height := int(h.WindowYMax) - int(h.WindowYMin) + 1
+	decompressed, err := decompressWithRLE(data)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
-	_, err = r.Seek(128, io.SeekStart)
+	lineStride := int(h.BytesPerPlaneLine)
+	rowStride := lineStride * int(h.NumPlanes)
+	if len(decompressed) < height*rowStride {
+		return nil, fmt.Errorf("pcx: decompressed data too short for %d scanlines of %d bytes", height, rowStride)
+	}
+	img := image.NewPaletted(image.Rect(0, 0, width, height), palette16FromHeader(h))
+	for y := 0; y < height; y++ {
+		row := decompressed[y*rowStride : (y+1)*rowStride]
+		for x := 0; x < width; x++ {
+			byteIdx := x / 8
+			bit := uint(7 - x%8)
+			var idx byte
+			for p := 0; p < int(h.NumPlanes); p++ {
+				plane := row[p*lineStride : (p+1)*lineStride]
+				idx |= ((plane[byteIdx] >> bit) & 1) << uint(p)
+			}
+			img.SetColorIndex(x, y, idx)
+		}
+	}
+	return img, nil
+}
+
+// decode24BitPlanes decodes 8bpp x 3-plane truecolor images, where each
+// scanline stores a full R run, then a full G run, then a full B run.
+func decode24BitPlanes(h Header, data []byte) (image.Image, error) {
+	width := int(h.WindowXMax) - int(h.WindowXMin) + 1
+	height := int(h.WindowYMax) - int(h.WindowYMin) + 1
+	decompressed, err := decompressWithRLE(data)
 	if err != nil {
-		return result, err
+		return nil, err
+	}
+	lineStride := int(h.BytesPerPlaneLine)
+	rowStride := lineStride * 3
+	if len(decompressed) < height*rowStride {
+		return nil, fmt.Errorf("pcx: decompressed data too short for %d scanlines of %d bytes", height, rowStride)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := decompressed[y*rowStride : (y+1)*rowStride]
+		rPlane, gPlane, bPlane := row[:lineStride], row[lineStride:2*lineStride], row[2*lineStride:3*lineStride]
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{rPlane[x], gPlane[x], bPlane[x], 0xff})
+		}
+	}
+	return img, nil
+}
+
+// EncodeConfig controls how Encode represents an image as PCX. The zero
+// value writes *image.Paletted images as 8-bit paletted PCX and any other
+// image.Image as 24-bit truecolor.
+type EncodeConfig struct {
+	// Palette, when non-nil, quantizes m to this palette and writes 8-bit
+	// paletted output instead of 24-bit truecolor. It is ignored when m is
+	// already *image.Paletted, which is written with its own palette.
+	Palette color.Palette
+}
+
+// Encode writes m to w in PCX format, choosing 8-bit paletted or 24-bit
+// truecolor output automatically. Use EncodeWithConfig to force paletted
+// output for an image.Image that isn't already *image.Paletted.
+func Encode(w io.Writer, m image.Image) error {
+	return EncodeWithConfig(w, m, EncodeConfig{})
+}
+
+// EncodeWithConfig writes m to w in PCX format using cfg to decide between
+// paletted and truecolor output.
+func EncodeWithConfig(w io.Writer, m image.Image, cfg EncodeConfig) error {
+	b := m.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return fmt.Errorf("pcx: invalid image size %dx%d", b.Dx(), b.Dy())
+	}
+
+	paletted, _ := m.(*image.Paletted)
+	if paletted == nil && cfg.Palette != nil {
+		p := image.NewPaletted(b, cfg.Palette)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				p.Set(x, y, cfg.Palette.Convert(m.At(x, y)))
+			}
+		}
+		paletted = p
+	}
+
+	if paletted != nil {
+		return encode8Bit(w, paletted)
+	}
+	return encode24Bit(w, m)
+}
+
+func newHeader(width, height int, numPlanes, bpp byte, bytesPerLine uint16) Header {
+	return Header{
+		Marker:               0x0a,
+		Version:              5,
+		Encoding:             1,
+		BitsPerPixelPerPlane: bpp,
+		WindowXMax:           uint16(width - 1),
+		WindowYMax:           uint16(height - 1),
+		VerticalDPI:          300,
+		HorizontalDPI:        300,
+		NumPlanes:            numPlanes,
+		BytesPerPlaneLine:    bytesPerLine,
+		PaletteInfo:          1,
+		HorizontalScreenSize: uint16(width),
+		VerticalScreenSize:   uint16(height),
+	}
+}
+
+func encode8Bit(w io.Writer, m *image.Paletted) error {
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+	bytesPerLine := uint16(width)
+	if bytesPerLine%2 != 0 {
+		bytesPerLine++
+	}
+	h := newHeader(width, height, 1, 8, bytesPerLine)
+	if err := binary.Write(w, binary.LittleEndian, &h); err != nil {
+		return err
+	}
+	row := make([]byte, bytesPerLine)
+	for y := 0; y < height; y++ {
+		for x := 0; x < int(bytesPerLine); x++ {
+			if x < width {
+				row[x] = m.Pix[m.PixOffset(b.Min.X+x, b.Min.Y+y)]
+			} else {
+				row[x] = 0
+			}
+		}
+		if err := encodeRLE(w, row); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write([]byte{0x0c}); err != nil {
+		return err
+	}
+	palette := make([]byte, 0x300)
+	for i, c := range m.Palette {
+		if i >= 256 {
+			break
+		}
+		r, g, bl, _ := c.RGBA()
+		palette[i*3] = byte(r >> 8)
+		palette[i*3+1] = byte(g >> 8)
+		palette[i*3+2] = byte(bl >> 8)
+	}
+	_, err := w.Write(palette)
+	return err
+}
+
+func encode24Bit(w io.Writer, m image.Image) error {
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+	bytesPerLine := uint16(width)
+	if bytesPerLine%2 != 0 {
+		bytesPerLine++
+	}
+	h := newHeader(width, height, 3, 8, bytesPerLine)
+	if err := binary.Write(w, binary.LittleEndian, &h); err != nil {
+		return err
+	}
+	planes := [3][]byte{make([]byte, bytesPerLine), make([]byte, bytesPerLine), make([]byte, bytesPerLine)}
+	for y := 0; y < height; y++ {
+		for x := 0; x < int(bytesPerLine); x++ {
+			if x < width {
+				r, g, bl, _ := m.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				planes[0][x] = byte(r >> 8)
+				planes[1][x] = byte(g >> 8)
+				planes[2][x] = byte(bl >> 8)
+			} else {
+				planes[0][x], planes[1][x], planes[2][x] = 0, 0, 0
+			}
+		}
+		for _, plane := range planes {
+			if err := encodeRLE(w, plane); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeRLE writes row using the PCX run-length scheme: a byte with its top
+// two bits set introduces a run, encoded as that byte (0xc0|count) followed
+// by the repeated value. A literal byte whose own top two bits are set must
+// itself be written as a run of length one, or a decoder would mistake it
+// for a run-count byte.
+func encodeRLE(w io.Writer, row []byte) error {
+	i := 0
+	for i < len(row) {
+		j := i + 1
+		for j < len(row) && j-i < 0x3f && row[j] == row[i] {
+			j++
+		}
+		count := j - i
+		if count > 1 || row[i] >= 0xc0 {
+			if _, err := w.Write([]byte{0xc0 | byte(count), row[i]}); err != nil {
+				return err
+			}
+		} else {
+			if _, err := w.Write([]byte{row[i]}); err != nil {
+				return err
+			}
+		}
+		i = j
 	}
-	result.Data = make([]byte, n-129)
-	_, err = r.Read(result.Data)
+	return nil
+}
+
+// LoadContainer reads a PCX file's header and scanline data into a
+// Container without decoding it into an image.Image, so callers can
+// inspect raw header fields such as DPI, PaletteInfo and NumPlanes.
+func LoadContainer(r io.Reader) (*Container, error) {
+	c, err := loadImage(r)
 	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// loadImage reads a Container in a single forward pass over r: the header,
+// then each scanline's RLE run decompressed directly into Data, and
+// finally (for 8bpp x 1-plane images) the trailing 256-color palette. It
+// needs nothing more than io.Reader, so pipes and network streams work as
+// well as files.
+func loadImage(r io.Reader) (Container, error) {
+	result := Container{}
+	headerRaw := make([]byte, 128)
+	if _, err := io.ReadFull(r, headerRaw); err != nil {
 		return result, err
 	}
-	_, err = r.Seek(1, io.SeekCurrent)
-	if err != nil {
+	if err := binary.Read(bytes.NewReader(headerRaw), binary.LittleEndian, &result.Header); err != nil {
 		return result, err
 	}
-	rawPalette := make([]byte, 0x300)
-	_, err = r.Read(rawPalette)
+
+	height := int(result.Header.WindowYMax) - int(result.Header.WindowYMin) + 1
+	stride := int(result.Header.BytesPerPlaneLine) * int(result.Header.NumPlanes)
+	result.Data = make([]byte, height*stride)
+
+	dec := newRLEDecoder(r)
+	for y := 0; y < height; y++ {
+		if err := dec.readRow(result.Data[y*stride : (y+1)*stride]); err != nil {
+			return result, err
+		}
+	}
+
+	if result.Header.BitsPerPixelPerPlane == 8 && result.Header.NumPlanes == 1 {
+		pal, err := dec.readTrailingPalette()
+		if err != nil {
+			return result, err
+		}
+		result.Palette = pal
+	}
+
+	return result, nil
+}
+
+// rleDecoder streams PCX run-length encoded scanlines off an underlying
+// io.Reader through a bufio.Reader, so a command byte and its run value may
+// straddle the reader's own Read boundaries. The bufio.Reader reads ahead of
+// the decoded position by up to its default buffer size.
+type rleDecoder struct {
+	r *bufio.Reader
+}
+
+func newRLEDecoder(r io.Reader) *rleDecoder {
+	return &rleDecoder{r: bufio.NewReader(r)}
+}
+
+// readRow fills out with exactly len(out) decompressed bytes. PCX runs
+// never cross a scanline boundary, so each call begins and ends on a
+// complete compressed unit.
+func (d *rleDecoder) readRow(out []byte) error {
+	i := 0
+	for i < len(out) {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if c < 0xc0 {
+			out[i] = c
+			i++
+			continue
+		}
+		count := int(c & 0x3f)
+		v, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if i+count > len(out) {
+			return fmt.Errorf("pcx: run of %d bytes overruns scanline", count)
+		}
+		for j := 0; j < count; j++ {
+			out[i] = v
+			i++
+		}
+	}
+	return nil
+}
+
+// readTrailingPalette reads the 0x0c marker and the 256-color VGA palette
+// that immediately follows the last scanline.
+func (d *rleDecoder) readTrailingPalette() ([]color.Color, error) {
+	marker, err := d.r.ReadByte()
 	if err != nil {
-		return result, err
+		return nil, err
+	}
+	if marker != 0x0c {
+		return nil, fmt.Errorf("pcx: missing 256-color palette marker")
 	}
+	rawPalette := make([]byte, 0x300)
+	if _, err := io.ReadFull(d.r, rawPalette); err != nil {
+		return nil, err
+	}
+	palette := make([]color.Color, 0, 256)
 	for i := 0; i < 0x300; i += 3 {
-		pc := color.RGBA{rawPalette[i], rawPalette[i+1], rawPalette[i+2], 0xff}
-		result.Palette = append(result.Palette, pc)
+		palette = append(palette, color.RGBA{rawPalette[i], rawPalette[i+1], rawPalette[i+2], 0xff})
 	}
-	return result, nil
+	return palette, nil
 }
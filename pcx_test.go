@@ -0,0 +1,80 @@
+package pcx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeDecodeRoundTrip8Bit(t *testing.T) {
+	pal := color.Palette{
+		color.RGBA{0, 0, 0, 0xff},
+		color.RGBA{0xff, 0, 0, 0xff},
+		color.RGBA{0, 0xff, 0, 0xff},
+		color.RGBA{0, 0, 0xff, 0xff},
+	}
+	const width, height = 5, 3 // odd width exercises even-byte scanline padding
+	src := image.NewPaletted(image.Rect(0, 0, width, height), pal)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			src.SetColorIndex(x, y, uint8((x+y)%len(pal)))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, src); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	got, err := Decode8Bit256Color(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode8Bit256Color: %v", err)
+	}
+	gotBounds := got.Bounds()
+	if gotBounds.Dx() != width || gotBounds.Dy() != height {
+		t.Fatalf("got size %dx%d, want %dx%d", gotBounds.Dx(), gotBounds.Dy(), width, height)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			wantR, wantG, wantB, wantA := src.At(x, y).RGBA()
+			gotR, gotG, gotB, gotA := got.At(x, y).RGBA()
+			if wantR != gotR || wantG != gotG || wantB != gotB || wantA != gotA {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got.At(x, y), src.At(x, y))
+			}
+		}
+	}
+}
+
+func TestEncodeDecodeRoundTrip24Bit(t *testing.T) {
+	const width, height = 4, 3
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			src.Set(x, y, color.RGBA{uint8(x * 10), uint8(y * 20), uint8(x + y), 0xff})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, src); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	got, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	gotBounds := got.Bounds()
+	if gotBounds.Dx() != width || gotBounds.Dy() != height {
+		t.Fatalf("got size %dx%d, want %dx%d", gotBounds.Dx(), gotBounds.Dy(), width, height)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			wantR, wantG, wantB, wantA := src.At(x, y).RGBA()
+			gotR, gotG, gotB, gotA := got.At(x, y).RGBA()
+			if wantR != gotR || wantG != gotG || wantB != gotB || wantA != gotA {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got.At(x, y), src.At(x, y))
+			}
+		}
+	}
+}